@@ -17,6 +17,7 @@ package martian
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -25,18 +26,24 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"regexp"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"golang.org/x/net/http2"
+
+	"github.com/google/martian/v3/log"
 	"github.com/google/martian/v3/mitm"
 	"github.com/google/martian/v3/nosigpipe"
 	"github.com/google/martian/v3/proxyutil"
 	"github.com/google/martian/v3/trafficshape"
+	"github.com/google/martian/v3/tunnel"
 )
 
 var errClose = errors.New("closing connection")
@@ -44,25 +51,34 @@ var noop = Noop("martian")
 
 func isCloseable(err error) bool {
 	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-		fmt.Printf("martian: Closable Nettime out: %v\n", err)
+		log.Debugf("martian: closable net timeout: %v", err)
 		return true
 	}
 
 	switch err {
 	case io.EOF:
-		fmt.Printf("martian: Closable EOF")
+		log.Debugf("martian: closable EOF")
 		return true
 	case io.ErrClosedPipe:
-		fmt.Printf("martian: Closable ErrClosedPipe")
+		log.Debugf("martian: closable ErrClosedPipe")
 		return true
 	case errClose:
-		fmt.Printf("martian: Closable errClose")
+		log.Debugf("martian: closable errClose")
 		return true
 	}
 
 	return false
 }
 
+// connState records whether a tracked connection is idle (blocked waiting
+// for its next request) or actively being handled.
+type connState int
+
+const (
+	connIdle connState = iota
+	connActive
+)
+
 // Proxy is an HTTP proxy with support for TLS MITM and customizable behavior.
 type Proxy struct {
 	roundTripper http.RoundTripper
@@ -71,36 +87,114 @@ type Proxy struct {
 	mitm         *mitm.Config
 	proxyURL     *url.URL
 	conns        sync.WaitGroup
-	connsMu      sync.Mutex // protects conns.Add/Wait from concurrent access
+	connsMu      sync.Mutex // protects conns.Add/Wait and connState from concurrent access
+	connState    map[net.Conn]connState
 	closing      chan bool
+	closeOnce    sync.Once
+
+	shutdownCtx    context.Context
+	shutdownCancel context.CancelFunc
+
+	http2         bool
+	h2OverridesMu sync.RWMutex
+	h2Overrides   map[string]bool // host -> force HTTP/1.1 upstream
+
+	protocolsMu sync.RWMutex
+	protocols   map[string]http.RoundTripper
+
+	connectHandlersMu sync.RWMutex
+	connectHandlers   []connectHandlerEntry
+
+	tunnelPool     *tunnel.Pool
+	tunnelObserver tunnel.Observer
+
+	transportConfig    TransportConfig
+	transportConfigSet bool // whether SetTransportConfig has actually been called
+
+	connPoolMu    sync.Mutex
+	connPoolConns map[net.Conn]*connPoolEntry // tracked upstream conn -> its bookkeeping
 
 	reqmod RequestModifier
 	resmod ResponseModifier
 }
 
+// TransportConfig configures connection pooling and dial behavior for the
+// proxy's default upstream *http.Transport, mirroring the pool-related
+// fields of http.Transport; see that type's documentation for exact
+// semantics. Set it with Proxy.SetTransportConfig.
+type TransportConfig struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+	DisableKeepAlives     bool
+	ForceAttemptHTTP2     bool
+
+	// DialContext, if non-nil, replaces the proxy's own DialContext
+	// (which honors Proxy.SetDial and per-request cancellation) as the
+	// transport's dialer.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// ConnPoolStats is a snapshot of the proxy's upstream connection pool
+// usage, as reported by Proxy.ConnPoolStats.
+type ConnPoolStats struct {
+	// OpenConns is the number of upstream connections currently open
+	// (idle or in use) across all hosts.
+	OpenConns int
+	// OpenConnsByHost is OpenConns broken down by dialed host:port.
+	OpenConnsByHost map[string]int
+	// IdleConns is the number of open connections not currently
+	// servicing a round trip.
+	IdleConns int
+	// ActiveConnsByHost is the number of open connections currently
+	// servicing a round trip, broken down by dialed host:port.
+	ActiveConnsByHost map[string]int
+}
+
 // NewProxy returns a new HTTP proxy.
 func NewProxy() *Proxy {
 	proxy := &Proxy{
 		roundTripper: &http.Transport{
-			// TODO(adamtanner): This forces the http.Transport to not upgrade requests
-			// to HTTP/2 in Go 1.6+. Remove this once Martian can support HTTP/2.
+			// HTTP/2 upstream is opt-in via SetHTTP2; until enabled, keep
+			// origins on HTTP/1.1 by refusing to negotiate "h2" via ALPN.
 			TLSNextProto:          make(map[string]func(string, *tls.Conn) http.RoundTripper),
 			Proxy:                 http.ProxyFromEnvironment,
 			TLSHandshakeTimeout:   10 * time.Second,
 			ExpectContinueTimeout: time.Second,
 		},
-		timeout: 5 * time.Minute,
-		closing: make(chan bool),
-		reqmod:  noop,
-		resmod:  noop,
+		timeout:       5 * time.Minute,
+		closing:       make(chan bool),
+		connState:     make(map[net.Conn]connState),
+		h2Overrides:   make(map[string]bool),
+		tunnelPool:    tunnel.NewPool(0),
+		connPoolConns: make(map[net.Conn]*connPoolEntry),
+		reqmod:        noop,
+		resmod:        noop,
 	}
+	proxy.shutdownCtx, proxy.shutdownCancel = context.WithCancel(context.Background())
 	proxy.SetDial((&net.Dialer{
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
 	}).Dial)
+	proxy.applyHTTP2(proxy.roundTripper.(*http.Transport))
 	return proxy
 }
 
+// SetLogger sets the logger used for all martian log output, allowing
+// embedders to route proxy logging into their own logging infrastructure
+// (e.g. zap, logrus) instead of the default stderr logger.
+func (p *Proxy) SetLogger(l log.Logger) {
+	log.SetLogger(l)
+}
+
+// SetLogLevel sets the verbosity of martian log output. See the log package
+// for the available levels (log.Silent, log.Error, log.Info, log.Debug).
+func (p *Proxy) SetLogLevel(level int) {
+	log.SetLevel(level)
+}
+
 // GetRoundTripper gets the http.RoundTripper of the proxy.
 func (p *Proxy) GetRoundTripper() http.RoundTripper {
 	return p.roundTripper
@@ -111,12 +205,378 @@ func (p *Proxy) SetRoundTripper(rt http.RoundTripper) {
 	p.roundTripper = rt
 
 	if tr, ok := p.roundTripper.(*http.Transport); ok {
-		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 		tr.Proxy = http.ProxyURL(p.proxyURL)
-		tr.Dial = p.dial
+		p.applyHTTP2(tr)
+		p.applyDialContext(tr)
+		// Only stomp the caller's own pool tuning once SetTransportConfig
+		// has actually been called; otherwise a caller handing in a
+		// pre-tuned *http.Transport would have it silently reset to
+		// TransportConfig's zero values.
+		if p.transportConfigSet {
+			p.applyTransportConfig(tr)
+		}
+	}
+}
+
+// SetTransportConfig sets the connection pool and dialer configuration
+// applied to the proxy's underlying *http.Transport. It is preserved
+// across subsequent calls to SetRoundTripper, so swapping in a fresh
+// *http.Transport doesn't silently drop pool tuning.
+func (p *Proxy) SetTransportConfig(cfg TransportConfig) {
+	p.transportConfig = cfg
+	p.transportConfigSet = true
+
+	if tr, ok := p.roundTripper.(*http.Transport); ok {
+		p.applyTransportConfig(tr)
+		p.applyDialContext(tr)
+	}
+}
+
+// applyTransportConfig applies p.transportConfig's pool tuning to tr.
+func (p *Proxy) applyTransportConfig(tr *http.Transport) {
+	cfg := p.transportConfig
+
+	tr.MaxIdleConns = cfg.MaxIdleConns
+	tr.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	tr.MaxConnsPerHost = cfg.MaxConnsPerHost
+	tr.IdleConnTimeout = cfg.IdleConnTimeout
+	tr.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	tr.DisableKeepAlives = cfg.DisableKeepAlives
+	tr.ForceAttemptHTTP2 = cfg.ForceAttemptHTTP2
+}
+
+// applyDialContext wires tr's DialContext so dials route through
+// p.dialContext (honoring Proxy.SetDial and per-request cancellation),
+// unless TransportConfig.DialContext overrides it.
+func (p *Proxy) applyDialContext(tr *http.Transport) {
+	if p.transportConfig.DialContext != nil {
+		tr.DialContext = p.transportConfig.DialContext
+	} else {
+		tr.DialContext = p.dialContext
+	}
+}
+
+// connPoolEntry is the per-connection bookkeeping behind ConnPoolStats.
+type connPoolEntry struct {
+	host   string
+	active bool
+}
+
+// ConnPoolStats returns a snapshot of the proxy's upstream connection pool
+// usage, tracked as connections are dialed through Proxy.dialContext or
+// Proxy.dialTLSContext and later closed, and marked active or idle as round
+// trips claim and release them in Proxy.roundTrip. Upstream connections
+// that negotiated HTTP/2 are not counted.
+func (p *Proxy) ConnPoolStats() ConnPoolStats {
+	p.connPoolMu.Lock()
+	defer p.connPoolMu.Unlock()
+
+	byHost := make(map[string]int, len(p.connPoolConns))
+	activeByHost := make(map[string]int, len(p.connPoolConns))
+	idle := 0
+	for _, e := range p.connPoolConns {
+		byHost[e.host]++
+		if e.active {
+			activeByHost[e.host]++
+		} else {
+			idle++
+		}
+	}
+	return ConnPoolStats{
+		OpenConns:         len(p.connPoolConns),
+		OpenConnsByHost:   byHost,
+		IdleConns:         idle,
+		ActiveConnsByHost: activeByHost,
+	}
+}
+
+// dialContext dials addr using p.dial, honoring ctx cancellation so that a
+// caller such as Proxy.Shutdown can abort in-flight dials, and tracks the
+// resulting connection for ConnPoolStats.
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.dialWithContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return p.trackConn(conn, addr), nil
+}
+
+// trackConn wraps conn, dialed for addr, so its lifetime and in-use state
+// are reflected in ConnPoolStats until it is closed. A freshly dialed
+// connection starts out active, since it's about to service the round
+// trip that triggered the dial.
+func (p *Proxy) trackConn(conn net.Conn, addr string) net.Conn {
+	tc := &trackedConn{Conn: conn}
+	tc.release = func() {
+		p.connPoolMu.Lock()
+		defer p.connPoolMu.Unlock()
+		delete(p.connPoolConns, tc)
+	}
+
+	p.connPoolMu.Lock()
+	p.connPoolConns[tc] = &connPoolEntry{host: addr, active: true}
+	p.connPoolMu.Unlock()
+
+	return tc
+}
+
+// markConnActive marks conn as currently servicing a round trip, if it is
+// one tracked by trackConn.
+func (p *Proxy) markConnActive(conn net.Conn) {
+	p.connPoolMu.Lock()
+	defer p.connPoolMu.Unlock()
+	if e, ok := p.connPoolConns[conn]; ok {
+		e.active = true
 	}
 }
 
+// markConnIdle marks conn as not currently servicing a round trip, if it is
+// one tracked by trackConn.
+func (p *Proxy) markConnIdle(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	p.connPoolMu.Lock()
+	defer p.connPoolMu.Unlock()
+	if e, ok := p.connPoolConns[conn]; ok {
+		e.active = false
+	}
+}
+
+// dialWithContext runs p.dial in a goroutine and abandons it if ctx is
+// done first, closing the connection if the dial eventually succeeds
+// anyway.
+func (p *Proxy) dialWithContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	resc := make(chan result, 1)
+	go func() {
+		conn, err := p.dial(network, addr)
+		resc <- result{conn, err}
+	}()
+
+	select {
+	case res := <-resc:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-resc; res.err == nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// trackedConn wraps a net.Conn to invoke release exactly once when the
+// connection is closed, used to keep ConnPoolStats accurate.
+type trackedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// SetHTTP2 enables or disables HTTP/2 support for upstream round trips. When
+// enabled, the underlying *http.Transport is configured via
+// golang.org/x/net/http2 so that origins negotiating "h2" over TLS are
+// proxied natively instead of being forced down to HTTP/1.1. SetHTTP2 is a
+// no-op if the current round tripper is not an *http.Transport; callers
+// supplying their own http.RoundTripper are responsible for configuring
+// HTTP/2 themselves.
+func (p *Proxy) SetHTTP2(enabled bool) {
+	p.http2 = enabled
+
+	if tr, ok := p.roundTripper.(*http.Transport); ok {
+		p.applyHTTP2(tr)
+	}
+}
+
+// SetHTTP2ForHost overrides the proxy's HTTP/2 setting for a single upstream
+// host (host, or host:port as it appears in req.URL.Host), forcing the
+// upstream connection to stay on HTTP/1.1 even when HTTP/2 is enabled
+// globally. This is useful for origins with buggy or unsupported h2
+// implementations. Passing enabled=true removes a previously set override.
+func (p *Proxy) SetHTTP2ForHost(host string, enabled bool) {
+	host = stripPort(host)
+
+	p.h2OverridesMu.Lock()
+	defer p.h2OverridesMu.Unlock()
+
+	if enabled {
+		delete(p.h2Overrides, host)
+		return
+	}
+	p.h2Overrides[host] = true
+}
+
+// forcedHTTP1 reports whether host has been pinned to HTTP/1.1 via
+// SetHTTP2ForHost.
+func (p *Proxy) forcedHTTP1(host string) bool {
+	host = stripPort(host)
+
+	p.h2OverridesMu.RLock()
+	defer p.h2OverridesMu.RUnlock()
+	return p.h2Overrides[host]
+}
+
+// stripPort returns host with any trailing ":port" removed, so that
+// host-keyed lookups work whether or not the caller included a port.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// applyHTTP2 wires or tears down HTTP/2 upstream support on tr to match
+// p.http2. tr.DialTLSContext is always routed through p.dialTLSContext,
+// regardless of p.http2, so that every TLS upstream connection - not just
+// HTTP/2 ones - is dialed the same way and HTTP/1.1 ones are tracked for
+// ConnPoolStats; otherwise tr's own addTLS would wrap the connection
+// itself, and that wrapper's identity would never match what
+// Proxy.dialContext registered for ConnPoolStats.
+func (p *Proxy) applyHTTP2(tr *http.Transport) {
+	tr.DialTLSContext = p.dialTLSContext
+
+	if !p.http2 {
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		return
+	}
+
+	tr.TLSNextProto = nil
+	if err := http2.ConfigureTransport(tr); err != nil {
+		log.Errorf("martian: failed to configure HTTP/2 upstream transport: %v", err)
+	}
+}
+
+// dialTLSContext dials addr over TLS, using TransportConfig.DialContext for
+// the underlying connection if set. It only offers "h2" over ALPN when
+// HTTP/2 is enabled on the proxy and host hasn't been pinned to HTTP/1.1
+// via SetHTTP2ForHost. The handshaked TLS connection, not the raw dial, is
+// tracked for ConnPoolStats, since that's the conn identity the transport
+// actually pools and hands to Proxy.roundTrip's httptrace hooks. A
+// connection that negotiated "h2" is returned as the bare *tls.Conn and is
+// not tracked, since net/http only hands a *tls.Conn to its HTTP/2 upgrade.
+func (p *Proxy) dialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := p.dialWithContext
+	if p.transportConfig.DialContext != nil {
+		dial = p.transportConfig.DialContext
+	}
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{}
+	if tr, ok := p.roundTripper.(*http.Transport); ok && tr.TLSClientConfig != nil {
+		cfg = tr.TLSClientConfig.Clone()
+	}
+
+	cfg.NextProtos = []string{"http/1.1"}
+	if p.http2 {
+		if host, _, serr := net.SplitHostPort(addr); !(serr == nil && p.forcedHTTP1(host)) {
+			cfg.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	if cfg.ServerName == "" {
+		if host, _, serr := net.SplitHostPort(addr); serr == nil {
+			cfg.ServerName = host
+		}
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		return tlsConn, nil
+	}
+	return p.trackConn(tlsConn, addr), nil
+}
+
+// ConnectHandler implements a custom protocol on top of a hijacked CONNECT
+// tunnel, for use with RegisterConnectHandler. It is responsible for the
+// entire lifetime of the connection once ServeConnect returns control of
+// conn to it.
+type ConnectHandler interface {
+	// ServeConnect handles req, a CONNECT request whose Host matched the
+	// pattern it was registered under. peeked holds any bytes martian has
+	// already read off the wire while sniffing the tunnel; ServeConnect
+	// must treat them as the start of the stream before reading more from
+	// brw or conn. The CONNECT response has already been written by the
+	// time ServeConnect is called.
+	ServeConnect(req *http.Request, session *Session, peeked []byte, brw *bufio.ReadWriter, conn net.Conn) error
+}
+
+type connectHandlerEntry struct {
+	pattern string
+	handler ConnectHandler
+}
+
+// RegisterProtocol registers a RoundTripper to be used for a given URL
+// scheme, mirroring http.Transport.RegisterProtocol. Requests whose scheme
+// matches are dispatched to rt instead of the proxy's default
+// roundTripper, and martian leaves req.URL.Scheme untouched rather than
+// forcing it to "http"/"https". This lets embedders transparently proxy
+// non-HTTP schemes, such as ws:// or grpc://, through the same modifier
+// chain used for ordinary requests.
+func (p *Proxy) RegisterProtocol(scheme string, rt http.RoundTripper) {
+	p.protocolsMu.Lock()
+	defer p.protocolsMu.Unlock()
+
+	if p.protocols == nil {
+		p.protocols = make(map[string]http.RoundTripper)
+	}
+	p.protocols[scheme] = rt
+}
+
+// protocolRoundTripper returns the RoundTripper registered for scheme, if
+// any.
+func (p *Proxy) protocolRoundTripper(scheme string) (http.RoundTripper, bool) {
+	p.protocolsMu.RLock()
+	defer p.protocolsMu.RUnlock()
+
+	rt, ok := p.protocols[scheme]
+	return rt, ok
+}
+
+// RegisterConnectHandler registers h to handle CONNECT requests whose Host
+// matches hostPattern, a regular expression as accepted by regexp.MatchString.
+// Patterns are tried in registration order and the first match wins.
+// Registered handlers take priority over both MITM and the default tunnel
+// behavior, so a ConnectHandler can implement custom protocols (e.g.
+// record-and-replay backends) on top of hijacked CONNECTs without forking
+// proxy.go.
+func (p *Proxy) RegisterConnectHandler(hostPattern string, h ConnectHandler) {
+	p.connectHandlersMu.Lock()
+	defer p.connectHandlersMu.Unlock()
+
+	p.connectHandlers = append(p.connectHandlers, connectHandlerEntry{pattern: hostPattern, handler: h})
+}
+
+// connectHandler returns the first registered ConnectHandler whose pattern
+// matches host, or nil.
+func (p *Proxy) connectHandler(host string) ConnectHandler {
+	p.connectHandlersMu.RLock()
+	defer p.connectHandlersMu.RUnlock()
+
+	for _, e := range p.connectHandlers {
+		if match, _ := regexp.MatchString(e.pattern, host); match {
+			return e.handler
+		}
+	}
+	return nil
+}
+
 // SetDownstreamProxy sets the proxy that receives requests from the upstream
 // proxy.
 func (p *Proxy) SetDownstreamProxy(proxyURL *url.URL) {
@@ -137,6 +597,20 @@ func (p *Proxy) SetMITM(config *mitm.Config) {
 	p.mitm = config
 }
 
+// SetTunnelBufferSize sets the size, in bytes, of the buffers used to copy
+// data through CONNECT tunnels. It takes effect for tunnels established
+// after the call returns.
+func (p *Proxy) SetTunnelBufferSize(size int) {
+	p.tunnelPool = tunnel.NewPool(size)
+}
+
+// SetTunnelObserver sets the observer notified when a CONNECT tunnel
+// finishes proxying traffic, reporting byte counts and any per-direction
+// error for metrics. Passing nil disables reporting.
+func (p *Proxy) SetTunnelObserver(observer tunnel.Observer) {
+	p.tunnelObserver = observer
+}
+
 // SetDial sets the dial func used to establish a connection.
 func (p *Proxy) SetDial(dial func(string, string) (net.Conn, error)) {
 	p.dial = func(a, b string) (net.Conn, error) {
@@ -146,7 +620,7 @@ func (p *Proxy) SetDial(dial func(string, string) (net.Conn, error)) {
 	}
 
 	if tr, ok := p.roundTripper.(*http.Transport); ok {
-		tr.Dial = p.dial
+		p.applyDialContext(tr)
 	}
 }
 
@@ -154,15 +628,15 @@ func (p *Proxy) SetDial(dial func(string, string) (net.Conn, error)) {
 // finishes processing any inflight requests, and closes existing connections without
 // reading anymore requests from them.
 func (p *Proxy) Close() {
-	fmt.Printf("martian: closing down proxy")
+	log.Infof("martian: closing down proxy")
 
-	close(p.closing)
+	p.closeOnce.Do(func() { close(p.closing) })
 
-	fmt.Printf("martian: waiting for connections to close")
+	log.Debugf("martian: waiting for connections to close")
 	p.connsMu.Lock()
 	p.conns.Wait()
 	p.connsMu.Unlock()
-	fmt.Printf("martian: all connections closed")
+	log.Infof("martian: all connections closed")
 }
 
 // Closing returns whether the proxy is in the closing state.
@@ -175,6 +649,67 @@ func (p *Proxy) Closing() bool {
 	}
 }
 
+// Shutdown gracefully shuts down the proxy, in the manner of
+// http.Server.Shutdown: it stops Serve from accepting new connections,
+// immediately closes connections that are idle (blocked waiting for their
+// next request), and lets in-flight requests finish on their own. If ctx is
+// done before every connection has finished, Shutdown cancels outstanding
+// roundTrip calls, hard-closes whatever connections remain, and returns an
+// error identifying them.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	log.Infof("martian: shutting down proxy")
+
+	p.closeOnce.Do(func() { close(p.closing) })
+	p.closeIdleConns()
+
+	drained := make(chan struct{})
+	go func() {
+		p.conns.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Infof("martian: all connections drained")
+		return nil
+	case <-ctx.Done():
+		p.shutdownCancel()
+		return p.forceCloseRemaining()
+	}
+}
+
+// closeIdleConns closes every tracked connection that is currently idle,
+// i.e. blocked waiting for its next request rather than in the middle of
+// handling one.
+func (p *Proxy) closeIdleConns() {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	for conn, state := range p.connState {
+		if state == connIdle {
+			conn.Close()
+		}
+	}
+}
+
+// forceCloseRemaining hard-closes every connection still tracked by the
+// proxy and returns an error listing them, or nil if none remain.
+func (p *Proxy) forceCloseRemaining() error {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	var remaining []string
+	for conn := range p.connState {
+		remaining = append(remaining, conn.RemoteAddr().String())
+		conn.Close()
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("martian: shutdown deadline exceeded, force closed %d connection(s): %s", len(remaining), strings.Join(remaining, ", "))
+}
+
 // SetRequestModifier sets the request modifier.
 func (p *Proxy) SetRequestModifier(reqmod RequestModifier) {
 	if reqmod == nil {
@@ -204,7 +739,7 @@ func (p *Proxy) Serve(l net.Listener) error {
 		}
 
 		conn, err := l.Accept()
-		fmt.Println("received connection")
+		log.Debugf("martian: received connection")
 		nosigpipe.IgnoreSIGPIPE(conn)
 		if err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
@@ -217,27 +752,26 @@ func (p *Proxy) Serve(l net.Listener) error {
 					delay = max
 				}
 
-				fmt.Printf("martian: temporary error on accept: %v\n", err)
+				log.Errorf("martian: temporary error on accept: %v", err)
 				time.Sleep(delay)
 				continue
 			}
 
 			if errors.Is(err, net.ErrClosed) {
-				fmt.Printf("martian: listener closed, returning")
+				log.Infof("martian: listener closed, returning")
 				return err
 			}
 
-			fmt.Printf("martian: failed to accept: %v\n", err)
+			log.Errorf("martian: failed to accept: %v", err)
 			return err
 		}
 		delay = 0
-		fmt.Printf("martian: accepted connection from %s\n", conn.RemoteAddr())
+		log.Debugf("martian: accepted connection from %s", conn.RemoteAddr())
 
 		if tconn, ok := conn.(*net.TCPConn); ok {
 			tconn.SetKeepAlive(true)
 			tconn.SetKeepAlivePeriod(3 * time.Minute)
 		}
-		fmt.Println("handleloop")
 		go p.handleLoop(conn)
 	}
 }
@@ -245,8 +779,14 @@ func (p *Proxy) Serve(l net.Listener) error {
 func (p *Proxy) handleLoop(conn net.Conn) {
 	p.connsMu.Lock()
 	p.conns.Add(1)
+	p.connState[conn] = connIdle
 	p.connsMu.Unlock()
-	defer p.conns.Done()
+	defer func() {
+		p.connsMu.Lock()
+		delete(p.connState, conn)
+		p.connsMu.Unlock()
+		p.conns.Done()
+	}()
 	defer conn.Close()
 	if p.Closing() {
 		return
@@ -256,37 +796,54 @@ func (p *Proxy) handleLoop(conn net.Conn) {
 
 	s, err := newSession(conn, brw)
 	if err != nil {
-		fmt.Printf("martian: failed to create session: %v\n", err)
+		log.Errorf("martian: failed to create session: %v", err)
 		return
 	}
 
 	ctx, err := withSession(s)
 	if err != nil {
-		fmt.Printf("martian: failed to create context: %v\n", err)
+		log.Errorf("martian: failed to create context: %v", err)
 		return
 	}
 
 	for {
+		if p.Closing() {
+			log.Debugf("martian: proxy closing, dropping idle connection: %v", conn.RemoteAddr())
+			return
+		}
+
 		deadline := time.Now().Add(p.timeout)
 		conn.SetDeadline(deadline)
-		fmt.Println("handling")
+		log.Debugf("martian: handling connection: %v", conn.RemoteAddr())
+		// The connection is genuinely idle for as long as handle is
+		// blocked waiting to read the next request; handle itself marks
+		// it connActive once a request has actually arrived.
+		p.setConnState(conn, connIdle)
 		err := p.handle(ctx, conn, brw)
 		if isCloseable(err) {
-			fmt.Printf("martian: closing connection: %v\n", conn.RemoteAddr())
+			log.Debugf("martian: closing connection: %v", conn.RemoteAddr())
 			return
 		}
 	}
 }
 
+// setConnState updates the tracked state of conn, if it is still tracked.
+func (p *Proxy) setConnState(conn net.Conn, state connState) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	if _, ok := p.connState[conn]; ok {
+		p.connState[conn] = state
+	}
+}
+
 func (p *Proxy) readRequest(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) (*http.Request, error) {
 	var req *http.Request
-	fmt.Println("Reading request")
+	log.Debugf("martian: reading request: %v", conn.RemoteAddr())
 	reqc := make(chan *http.Request, 1)
 	errc := make(chan error, 1)
 	go func() {
-		tr := io.TeeReader(brw.Reader, os.Stdout)
-		btr := bufio.NewReader(tr)
-		r, err := http.ReadRequest(btr)
+		r, err := http.ReadRequest(brw.Reader)
 		if err != nil {
 			errc <- err
 			return
@@ -296,9 +853,9 @@ func (p *Proxy) readRequest(ctx *Context, conn net.Conn, brw *bufio.ReadWriter)
 	select {
 	case err := <-errc:
 		if isCloseable(err) {
-			fmt.Printf("martian: connection closed prematurely: %v\n", err)
+			log.Debugf("martian: connection closed prematurely: %v", err)
 		} else {
-			fmt.Printf("martian: failed to read request: %v\n", err)
+			log.Errorf("martian: failed to read request: %v", err)
 		}
 
 		// TODO: TCPConn.WriteClose() to avoid sending an RST to the client.
@@ -314,42 +871,56 @@ func (p *Proxy) readRequest(ctx *Context, conn net.Conn, brw *bufio.ReadWriter)
 
 func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *Session, brw *bufio.ReadWriter, conn net.Conn) error {
 	if err := p.reqmod.ModifyRequest(req); err != nil {
-		fmt.Printf("martian: error modifying CONNECT request: %v\n", err)
+		log.Errorf("martian: error modifying CONNECT request: %v", err)
 		proxyutil.Warning(req.Header, err)
 	}
 	if session.Hijacked() {
-		fmt.Printf("martian: connection hijacked by request modifier")
+		log.Debugf("martian: connection hijacked by request modifier")
 		return nil
 	}
 
+	if h := p.connectHandler(req.Host); h != nil {
+		log.Debugf("martian: dispatching CONNECT to registered handler: %s", req.Host)
+
+		res := proxyutil.NewResponse(200, nil, req)
+		if err := res.Write(brw); err != nil {
+			log.Errorf("martian: got error while writing response back to client: %v", err)
+			return err
+		}
+		if err := brw.Flush(); err != nil {
+			log.Errorf("martian: got error while flushing response back to client: %v", err)
+			return err
+		}
+
+		return h.ServeConnect(req, session, nil, brw, conn)
+	}
+
 	if p.mitm != nil {
-		fmt.Printf("martian: attempting MITM for connection: %s / %s\n", req.Host, req.URL.String())
+		log.Debugf("martian: attempting MITM for connection: %s / %s", req.Host, req.URL.String())
 
 		res := proxyutil.NewResponse(200, nil, req)
 
 		if err := p.resmod.ModifyResponse(res); err != nil {
-			fmt.Printf("martian: error modifying CONNECT response: %v\n", err)
+			log.Errorf("martian: error modifying CONNECT response: %v", err)
 			proxyutil.Warning(res.Header, err)
 		}
 		if session.Hijacked() {
-			fmt.Printf("martian: connection hijacked by response modifier")
+			log.Debugf("martian: connection hijacked by response modifier")
 			return nil
 		}
 
-		w := io.MultiWriter(os.Stdout, brw)
-
-		if err := res.Write(w); err != nil {
-			fmt.Printf("martian: got error while writing response back to client: %v\n", err)
+		if err := res.Write(brw); err != nil {
+			log.Errorf("martian: got error while writing response back to client: %v", err)
 		}
 		if err := brw.Flush(); err != nil {
-			fmt.Printf("martian: got error while flushing response back to client: %v\n", err)
+			log.Errorf("martian: got error while flushing response back to client: %v", err)
 		}
 
-		fmt.Printf("martian: completed MITM for connection: %s\n", req.Host)
+		log.Debugf("martian: completed MITM for connection: %s", req.Host)
 
 		b := make([]byte, 1)
 		if _, err := brw.Read(b); err != nil {
-			fmt.Printf("martian: error peeking message through CONNECT tunnel to determine type: %v\n", err)
+			log.Errorf("martian: error peeking message through CONNECT tunnel to determine type: %v", err)
 		}
 
 		// Drain all of the rest of the buffered data.
@@ -388,28 +959,28 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 		return p.handle(ctx, conn, brw)
 	}
 
-	fmt.Printf("martian: attempting to establish CONNECT tunnel: %s\n", req.URL.Host)
+	log.Debugf("martian: attempting to establish CONNECT tunnel: %s", req.URL.Host)
 	res, cconn, cerr := p.connect(req)
 	if cerr != nil {
-		fmt.Printf("martian: failed to CONNECT: %v\n", cerr)
+		log.Errorf("martian: failed to CONNECT: %v", cerr)
 		res = proxyutil.NewResponse(502, nil, req)
 		proxyutil.Warning(res.Header, cerr)
 
 		if err := p.resmod.ModifyResponse(res); err != nil {
-			fmt.Printf("martian: error modifying CONNECT response: %v\n", err)
+			log.Errorf("martian: error modifying CONNECT response: %v", err)
 			proxyutil.Warning(res.Header, err)
 		}
 		if session.Hijacked() {
-			fmt.Printf("martian: connection hijacked by response modifier")
+			log.Debugf("martian: connection hijacked by response modifier")
 			return nil
 		}
 
 		if err := res.Write(brw); err != nil {
-			fmt.Printf("martian: got error while writing response back to client: %v\n", err)
+			log.Errorf("martian: got error while writing response back to client: %v", err)
 		}
 		err := brw.Flush()
 		if err != nil {
-			fmt.Printf("martian: got error while flushing response back to client: %v\n", err)
+			log.Errorf("martian: got error while flushing response back to client: %v", err)
 		}
 		return err
 	}
@@ -417,61 +988,57 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 	defer cconn.Close()
 
 	if err := p.resmod.ModifyResponse(res); err != nil {
-		fmt.Printf("martian: error modifying CONNECT response: %v\n", err)
+		log.Errorf("martian: error modifying CONNECT response: %v", err)
 		proxyutil.Warning(res.Header, err)
 	}
 	if session.Hijacked() {
-		fmt.Printf("martian: connection hijacked by response modifier")
+		log.Debugf("martian: connection hijacked by response modifier")
 		return nil
 	}
 
 	res.ContentLength = -1
 	if err := res.Write(brw); err != nil {
-		fmt.Printf("martian: got error while writing response back to client: %v\n", err)
+		log.Errorf("martian: got error while writing response back to client: %v", err)
 	}
 	if err := brw.Flush(); err != nil {
-		fmt.Printf("martian: got error while flushing response back to client: %v\n", err)
+		log.Errorf("martian: got error while flushing response back to client: %v", err)
 	}
 
-	cbw := bufio.NewWriter(cconn)
-	cbr := bufio.NewReader(cconn)
-	defer cbw.Flush()
-
-	copySync := func(w io.Writer, r io.Reader, donec chan<- bool) {
-		if _, err := io.Copy(w, r); err != nil && err != io.EOF {
-			fmt.Printf("martian: failed to copy CONNECT tunnel: %v\n", err)
-		}
-
-		fmt.Printf("martian: CONNECT tunnel finished copying")
-		donec <- true
+	log.Debugf("martian: established CONNECT tunnel, proxying traffic")
+	// Threading p.shutdownCtx.Done() through lets Shutdown force-close this
+	// tunnel's connections once its drain deadline fires, the same way
+	// p.closing unblocks the H2Config CONNECT path above.
+	p.tunnelPool.Proxy(
+		p.shutdownCtx.Done(),
+		tunnel.Endpoint{Reader: brw, Writer: brw, Conn: conn},
+		tunnel.Endpoint{Reader: cconn, Writer: cconn, Conn: cconn},
+		p.tunnelObserver,
+	)
+	if err := brw.Flush(); err != nil {
+		log.Errorf("martian: got error while flushing response back to client: %v", err)
 	}
-
-	donec := make(chan bool, 2)
-	go copySync(cbw, brw, donec)
-	go copySync(brw, cbr, donec)
-
-	fmt.Printf("martian: established CONNECT tunnel, proxying traffic")
-	<-donec
-	<-donec
-	fmt.Printf("martian: closed CONNECT tunnel")
+	log.Debugf("martian: closed CONNECT tunnel")
 
 	return errClose
 }
 
 func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error {
-	fmt.Printf("martian: waiting for request: %v\n", conn.RemoteAddr())
+	log.Debugf("martian: waiting for request: %v", conn.RemoteAddr())
 
 	req, err := p.readRequest(ctx, conn, brw)
-	fmt.Println("read request")
 	if err != nil {
 		return err
 	}
 	defer req.Body.Close()
 
+	// A request has actually arrived off the wire, so the connection is no
+	// longer idle for Shutdown's purposes.
+	p.setConnState(conn, connActive)
+
 	session := ctx.Session()
 	ctx, err = withSession(session)
 	if err != nil {
-		fmt.Printf("martian: failed to build new context: %v\n", err)
+		log.Errorf("martian: failed to build new context: %v", err)
 		return err
 	}
 
@@ -495,10 +1062,12 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 		req.TLS = &cs
 	}
 
-	req.URL.Scheme = "http"
-	if session.IsSecure() {
-		fmt.Printf("martian: forcing HTTPS inside secure session")
-		req.URL.Scheme = "https"
+	if _, ok := p.protocolRoundTripper(req.URL.Scheme); !ok {
+		req.URL.Scheme = "http"
+		if session.IsSecure() {
+			log.Debugf("martian: forcing HTTPS inside secure session")
+			req.URL.Scheme = "https"
+		}
 	}
 
 	req.RemoteAddr = conn.RemoteAddr().String()
@@ -512,18 +1081,17 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 
 	// Not a CONNECT request
 	if err := p.reqmod.ModifyRequest(req); err != nil {
-		fmt.Printf("martian: error modifying request: %v\n", err)
+		log.Errorf("martian: error modifying request: %v", err)
 		proxyutil.Warning(req.Header, err)
 	}
 	if session.Hijacked() {
 		return nil
 	}
-	fmt.Println("round tripping")
+
 	// perform the HTTP roundtrip
 	res, err := p.roundTrip(ctx, req)
-	fmt.Println("round tripped")
 	if err != nil {
-		fmt.Printf("martian: failed to round trip: %v\n", err)
+		log.Errorf("martian: failed to round trip: %v", err)
 		res = proxyutil.NewResponse(502, nil, req)
 		proxyutil.Warning(res.Header, err)
 	}
@@ -534,17 +1102,17 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 	res.Request = req
 
 	if err := p.resmod.ModifyResponse(res); err != nil {
-		fmt.Printf("martian: error modifying response: %v\n", err)
+		log.Errorf("martian: error modifying response: %v", err)
 		proxyutil.Warning(res.Header, err)
 	}
 	if session.Hijacked() {
-		fmt.Printf("martian: connection hijacked by response modifier")
+		log.Debugf("martian: connection hijacked by response modifier")
 		return nil
 	}
 
 	var closing error
 	if req.Close || res.Close || p.Closing() {
-		fmt.Printf("martian: received close request: %v\n", req.RemoteAddr)
+		log.Debugf("martian: received close request: %v", req.RemoteAddr)
 		res.Close = true
 		closing = errClose
 	}
@@ -579,7 +1147,7 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 						ptsconn.Context.Buckets.WriteBucket.SetCapacity(
 							ptsconn.Context.ThrottleContext.Bandwidth)
 					}
-					fmt.Printf(
+					log.Debugf(
 						"trafficshape: Request %s with Range Start: %d matches a Shaping request %s. Enforcing Traffic shaping.",
 						req.URL, rangeStart, urlregex)
 				}
@@ -587,13 +1155,10 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 			}
 		}
 	}
-	// var b bytes.Buffer
-	w := io.MultiWriter(os.Stdout, brw)
-	fmt.Println("write res")
-	err = res.Write(w)
-	fmt.Println("wrote res")
+
+	err = res.Write(brw)
 	if err != nil {
-		fmt.Printf("martian: got error while writing response back to client: %v\n", err)
+		log.Errorf("martian: got error while writing response back to client: %v", err)
 		if _, ok := err.(*trafficshape.ErrForceClose); ok {
 			closing = errClose
 		}
@@ -602,19 +1167,9 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 		}
 	}
 
-	// nn, err := brw.Write(b.Bytes())
-	// _ = nn
-	// if err != nil {
-	// 	fmt.Printf("martian: got error while writing response back to client: %v\n", err)
-	// 	if _, ok := err.(*trafficshape.ErrForceClose); ok {
-	// 		closing = errClose
-	// 	}
-	// }
-	fmt.Println("flush")
 	err = brw.Flush()
-	fmt.Println("flushed")
 	if err != nil {
-		fmt.Printf("martian: got error while flushing response back to client: %v\n", err)
+		log.Errorf("martian: got error while flushing response back to client: %v", err)
 		if _, ok := err.(*trafficshape.ErrForceClose); ok {
 			closing = errClose
 		}
@@ -646,15 +1201,15 @@ func isOtherClosableError(err error) bool {
 	switch t := err.(type) {
 	case *net.OpError:
 		if t.Op == "dial" {
-			println("Unknown host")
+			log.Debugf("martian: unknown host: %v", t)
 			return true
 		} else if t.Op == "read" {
-			println("Connection refused")
+			log.Debugf("martian: connection refused: %v", t)
 			return true
 		}
 	case syscall.Errno:
 		if t == syscall.ECONNREFUSED {
-			println("Connection refused")
+			log.Debugf("martian: connection refused: %v", t)
 			return true
 		}
 	case *os.PathError:
@@ -683,16 +1238,74 @@ func (c *peekedConn) Read(buf []byte) (int, error) { return c.r.Read(buf) }
 
 func (p *Proxy) roundTrip(ctx *Context, req *http.Request) (*http.Response, error) {
 	if ctx.SkippingRoundTrip() {
-		fmt.Printf("martian: skipping round trip")
+		log.Debugf("martian: skipping round trip")
 		return proxyutil.NewResponse(200, nil, req), nil
 	}
 
-	return p.roundTripper.RoundTrip(req)
+	// Derive from req.Context() rather than replacing it outright, so any
+	// values or cancellation a RequestModifier attached survive, while
+	// still letting Shutdown abort the round trip once its drain deadline
+	// fires. cancel is invoked once the response body is closed, or
+	// immediately if the round trip itself fails, so it never outlives
+	// the response it belongs to.
+	reqCtx, cancel := context.WithCancel(req.Context())
+	go func() {
+		select {
+		case <-p.shutdownCtx.Done():
+			cancel()
+		case <-reqCtx.Done():
+		}
+	}()
+	// Track which pooled upstream connection services this round trip, so
+	// ConnPoolStats can report it as active while in use and idle once the
+	// transport returns it to the pool.
+	var conn net.Conn
+	reqCtx = httptrace.WithClientTrace(reqCtx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = info.Conn
+			p.markConnActive(conn)
+		},
+		PutIdleConn: func(err error) {
+			if err == nil {
+				p.markConnIdle(conn)
+			}
+		},
+	})
+	req = req.WithContext(reqCtx)
+
+	var (
+		res *http.Response
+		err error
+	)
+	if rt, ok := p.protocolRoundTripper(req.URL.Scheme); ok {
+		log.Debugf("martian: dispatching %s scheme to registered protocol handler", req.URL.Scheme)
+		res, err = rt.RoundTrip(req)
+	} else {
+		res, err = p.roundTripper.RoundTrip(req)
+	}
+	if err != nil {
+		cancel()
+		return res, err
+	}
+	res.Body = &cancelOnCloseBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelOnCloseBody cancels the round trip's derived shutdown-aware
+// context once the response body is closed.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
 }
 
 func (p *Proxy) connect(req *http.Request) (*http.Response, net.Conn, error) {
 	if p.proxyURL != nil {
-		fmt.Printf("martian: CONNECT with downstream proxy: %s\n", p.proxyURL.Host)
+		log.Debugf("martian: CONNECT with downstream proxy: %s", p.proxyURL.Host)
 
 		conn, err := p.dial("tcp", p.proxyURL.Host)
 		if err != nil {
@@ -712,7 +1325,7 @@ func (p *Proxy) connect(req *http.Request) (*http.Response, net.Conn, error) {
 		return res, conn, nil
 	}
 
-	fmt.Printf("martian: CONNECT to host directly: %s\n", req.URL.Host)
+	log.Debugf("martian: CONNECT to host directly: %s", req.URL.Host)
 
 	conn, err := p.dial("tcp", req.URL.Host)
 	if err != nil {
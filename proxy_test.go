@@ -0,0 +1,250 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// closeTrackingConn is a net.Conn that records whether Close was called,
+// used to confirm an abandoned dial's connection is cleaned up instead of
+// leaking.
+type closeTrackingConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *closeTrackingConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestDialWithContextAbandonsSlowDial(t *testing.T) {
+	dialStarted := make(chan struct{})
+	releaseDial := make(chan struct{})
+	dialedConn := &closeTrackingConn{closed: make(chan struct{})}
+
+	p := &Proxy{
+		dial: func(network, addr string) (net.Conn, error) {
+			close(dialStarted)
+			<-releaseDial
+			return dialedConn, nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	var gotErr error
+	go func() {
+		_, gotErr = p.dialWithContext(ctx, "tcp", "example.com:443")
+		close(done)
+	}()
+
+	<-dialStarted
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dialWithContext did not return promptly after ctx was canceled")
+	}
+	if gotErr != context.Canceled {
+		t.Errorf("dialWithContext err = %v, want context.Canceled", gotErr)
+	}
+
+	// The dial eventually "succeeds" after dialWithContext has already
+	// given up; the resulting connection must still be closed rather than
+	// leaked.
+	close(releaseDial)
+	select {
+	case <-dialedConn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("abandoned dial's connection was never closed")
+	}
+}
+
+func TestShutdownForceClosesRemainingConnections(t *testing.T) {
+	p := NewProxy()
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	p.connsMu.Lock()
+	p.conns.Add(1)
+	p.connState[serverConn] = connActive
+	p.connsMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := p.Shutdown(ctx)
+	if err == nil {
+		t.Fatal("Shutdown returned nil error, want an error listing the still-open connection")
+	}
+
+	// serverConn should have been force-closed by forceCloseRemaining, so
+	// a read on its peer observes an error instead of hanging.
+	buf := make([]byte, 1)
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, rerr := clientConn.Read(buf); rerr == nil {
+		t.Error("clientConn.Read succeeded, want error after serverConn was force-closed")
+	}
+
+	// Mirror handleLoop's bookkeeping so the WaitGroup isn't left unbalanced.
+	p.connsMu.Lock()
+	delete(p.connState, serverConn)
+	p.connsMu.Unlock()
+	p.conns.Done()
+}
+
+// TestShutdownClosesIdleConnectionsImmediately exercises the idle half of
+// handleLoop's state machine: a connection currently blocked waiting for
+// its next request (connIdle) must be closed by closeIdleConns as soon as
+// Shutdown is called, well before ctx's deadline, unlike a connection
+// actively servicing a request (connActive).
+func TestShutdownClosesIdleConnectionsImmediately(t *testing.T) {
+	p := NewProxy()
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	p.connsMu.Lock()
+	p.conns.Add(1)
+	p.connState[serverConn] = connIdle
+	p.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.conns.Wait()
+		close(done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- p.Shutdown(ctx) }()
+
+	// closeIdleConns should force serverConn closed right away, long
+	// before the 5s deadline.
+	buf := make([]byte, 1)
+	clientConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, rerr := clientConn.Read(buf); rerr == nil {
+		t.Error("clientConn.Read succeeded, want error from prompt idle close")
+	}
+
+	// Mirror handleLoop's bookkeeping so Shutdown observes the connection
+	// as drained rather than waiting out the deadline.
+	p.connsMu.Lock()
+	delete(p.connState, serverConn)
+	p.connsMu.Unlock()
+	p.conns.Done()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("conns.Wait() never unblocked after the idle connection's bookkeeping was cleared")
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown returned %v, want nil since the idle connection drained before the deadline", err)
+	}
+}
+
+// TestSetRoundTripperPreservesCallerPoolTuning confirms SetRoundTripper
+// doesn't stomp a caller-supplied *http.Transport's pool configuration
+// when SetTransportConfig was never called.
+func TestSetRoundTripperPreservesCallerPoolTuning(t *testing.T) {
+	p := NewProxy()
+
+	tr := &http.Transport{
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     42 * time.Second,
+	}
+	p.SetRoundTripper(tr)
+
+	if tr.MaxIdleConnsPerHost != 100 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 100 (caller's own tuning should survive)", tr.MaxIdleConnsPerHost)
+	}
+	if tr.IdleConnTimeout != 42*time.Second {
+		t.Errorf("IdleConnTimeout = %v, want 42s (caller's own tuning should survive)", tr.IdleConnTimeout)
+	}
+	// The proxy's dialer must still be wired in regardless, so SetDial
+	// keeps working with a caller-supplied transport.
+	if tr.DialContext == nil {
+		t.Error("DialContext is nil, want it wired to the proxy's dialer")
+	}
+
+	// Once SetTransportConfig is called, it does take effect.
+	p.SetTransportConfig(TransportConfig{MaxIdleConnsPerHost: 7})
+	if tr.MaxIdleConnsPerHost != 7 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 7 after SetTransportConfig", tr.MaxIdleConnsPerHost)
+	}
+}
+
+// TestDialTLSContextTracksConnForPlainHTTPS confirms that the conn
+// dialTLSContext hands back to the transport is the exact object
+// ConnPoolStats tracks, even when HTTP/2 is disabled. Before DialTLSContext
+// was wired unconditionally in applyHTTP2, a disabled-HTTP/2 transport did
+// its own internal TLS dial/wrap (net/http.Transport's addTLS), so
+// markConnActive/markConnIdle's lookups by httptrace.GotConnInfo.Conn never
+// matched what trackConn had registered.
+func TestDialTLSContextTracksConnForPlainHTTPS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	p := NewProxy()
+	p.SetDial(func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, srv.Listener.Addr().String())
+	})
+	tr := &http.Transport{TLSClientConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig}
+	p.SetRoundTripper(tr)
+
+	if tr.DialTLSContext == nil {
+		t.Fatal("DialTLSContext is nil, want it wired even with HTTP/2 disabled")
+	}
+
+	conn, err := tr.DialTLSContext(context.Background(), "tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("DialTLSContext: %v", err)
+	}
+	defer conn.Close()
+
+	stats := p.ConnPoolStats()
+	if stats.OpenConns != 1 {
+		t.Fatalf("OpenConns = %d, want 1", stats.OpenConns)
+	}
+
+	// Simulate roundTrip's httptrace hooks, keyed by the exact conn the
+	// transport was handed, the way net/http actually reports it via
+	// httptrace.GotConnInfo.Conn when DialTLSContext is set.
+	p.markConnIdle(conn)
+	if stats := p.ConnPoolStats(); stats.IdleConns != 1 {
+		t.Errorf("IdleConns = %d, want 1 after markConnIdle on dialTLSContext's own conn", stats.IdleConns)
+	}
+
+	p.markConnActive(conn)
+	if stats := p.ConnPoolStats(); stats.IdleConns != 0 {
+		t.Errorf("IdleConns = %d, want 0 after markConnActive", stats.IdleConns)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tunnel proxies bytes between the two ends of a hijacked CONNECT
+// tunnel. It uses a pool of reusable buffers instead of allocating one per
+// copy, and half-closes each side's write direction as soon as its read
+// direction sees EOF, so that a peer that half-closes its own connection
+// (common for pipelined HTTP/1.1 uploads and for gRPC-over-CONNECT) doesn't
+// wedge the tunnel until the read timeout fires.
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// DefaultBufferSize is the size of the buffers a Pool hands out when
+// constructed with a bufferSize <= 0.
+const DefaultBufferSize = 32 * 1024
+
+// Observer receives the outcome of a tunnel once both directions have
+// finished copying, for use in metrics and logging.
+type Observer interface {
+	// OnClose reports the number of bytes copied in each direction and any
+	// per-direction error. Errors are reported separately so that shaping
+	// or close decisions can react to which side actually failed instead
+	// of guessing from a single combined error.
+	OnClose(clientToUpstream, upstreamToClient int64, clientErr, upstreamErr error)
+}
+
+// halfCloser is implemented by connections, such as *net.TCPConn and
+// *tls.Conn, that support closing only their write half.
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// Endpoint is one side of a tunnel.
+type Endpoint struct {
+	Reader io.Reader
+	Writer io.Writer
+
+	// Conn is the underlying connection for this side. Once the other
+	// side's copy into this Endpoint's Writer finishes, Conn is
+	// half-closed for writing if it implements CloseWrite, propagating
+	// EOF to the peer as a real FIN instead of leaving the tunnel wedged.
+	// Conn may be nil, or may be the same value as Reader/Writer.
+	Conn net.Conn
+}
+
+// Pool proxies CONNECT tunnels using buffers drawn from a sync.Pool sized
+// at construction time.
+type Pool struct {
+	bufferSize int
+	bufs       sync.Pool
+}
+
+// NewPool returns a Pool whose buffers are bufferSize bytes. A bufferSize
+// <= 0 selects DefaultBufferSize.
+func NewPool(bufferSize int) *Pool {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	p := &Pool{bufferSize: bufferSize}
+	p.bufs.New = func() interface{} {
+		buf := make([]byte, p.bufferSize)
+		return &buf
+	}
+	return p
+}
+
+// Proxy copies data bidirectionally between client and upstream until both
+// directions have finished, then reports the result to observer, if
+// non-nil. Proxy blocks until both directions are done.
+//
+// If done is non-nil and is closed before both directions finish on their
+// own (for example because a caller is enforcing a shutdown deadline),
+// Proxy force-closes client.Conn and upstream.Conn to unblock whichever
+// side is stuck on a read, then waits for both copies to actually exit
+// before returning. A nil done behaves as if it were never closed.
+func (p *Pool) Proxy(done <-chan struct{}, client, upstream Endpoint, observer Observer) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	var clientToUpstream, upstreamToClient int64
+	var clientErr, upstreamErr error
+
+	go func() {
+		defer wg.Done()
+		clientToUpstream, clientErr = p.copyHalfClose(upstream, client)
+	}()
+	go func() {
+		defer wg.Done()
+		upstreamToClient, upstreamErr = p.copyHalfClose(client, upstream)
+	}()
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-done:
+		if client.Conn != nil {
+			client.Conn.Close()
+		}
+		if upstream.Conn != nil {
+			upstream.Conn.Close()
+		}
+		<-finished
+	}
+
+	if observer != nil {
+		observer.OnClose(clientToUpstream, upstreamToClient, clientErr, upstreamErr)
+	}
+}
+
+// copyHalfClose copies from src.Reader to dst.Writer using a pooled buffer.
+// Once src is exhausted, it half-closes dst.Conn's write side so the peer
+// on that side observes a clean FIN rather than waiting for the whole
+// tunnel to tear down.
+func (p *Pool) copyHalfClose(dst, src Endpoint) (int64, error) {
+	bufp := p.bufs.Get().(*[]byte)
+	defer p.bufs.Put(bufp)
+
+	n, err := io.CopyBuffer(dst.Writer, src.Reader, *bufp)
+	if err == io.EOF {
+		err = nil
+	}
+
+	if hc, ok := dst.Conn.(halfCloser); ok {
+		if cerr := hc.CloseWrite(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return n, err
+}
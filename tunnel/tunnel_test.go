@@ -0,0 +1,206 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver captures the single OnClose call a test cares about.
+type recordingObserver struct {
+	mu                                 sync.Mutex
+	called                             bool
+	clientToUpstream, upstreamToClient int64
+	clientErr, upstreamErr             error
+}
+
+func (o *recordingObserver) OnClose(clientToUpstream, upstreamToClient int64, clientErr, upstreamErr error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.called = true
+	o.clientToUpstream = clientToUpstream
+	o.upstreamToClient = upstreamToClient
+	o.clientErr = clientErr
+	o.upstreamErr = upstreamErr
+}
+
+// tcpPipe returns both ends of a loopback TCP connection. Unlike net.Pipe,
+// its conns implement CloseWrite, so Proxy can half-close them.
+func tcpPipe(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+
+	acceptc := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		acceptc <- c
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	accepted := <-acceptc
+	if accepted == nil {
+		t.Fatal("Accept failed")
+	}
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+func TestProxyHalfClosePropagation(t *testing.T) {
+	clientConn, clientPeer := tcpPipe(t)
+	upstreamConn, upstreamPeer := tcpPipe(t)
+	defer clientPeer.Close()
+	defer upstreamPeer.Close()
+
+	obs := &recordingObserver{}
+	pool := NewPool(0)
+
+	done := make(chan struct{})
+	go func() {
+		pool.Proxy(
+			done,
+			Endpoint{Reader: clientConn, Writer: clientConn, Conn: clientConn},
+			Endpoint{Reader: upstreamConn, Writer: upstreamConn, Conn: upstreamConn},
+			obs,
+		)
+		close(done)
+	}()
+
+	if _, err := clientPeer.Write([]byte("hello")); err != nil {
+		t.Fatalf("clientPeer.Write: %v", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(upstreamPeer, got); err != nil {
+		t.Fatalf("upstreamPeer read: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("upstream got %q, want %q", got, "hello")
+	}
+
+	// Closing the client side should propagate to the upstream peer as a
+	// FIN via CloseWrite, which the peer reports as io.EOF on the next read.
+	clientPeer.Close()
+
+	buf := make([]byte, 1)
+	if _, err := upstreamPeer.Read(buf); err != io.EOF {
+		t.Errorf("upstreamPeer read after clientPeer close: got err %v, want io.EOF", err)
+	}
+
+	upstreamPeer.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Proxy did not return after both sides closed")
+	}
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if !obs.called {
+		t.Fatal("observer.OnClose was never called")
+	}
+	if obs.clientToUpstream != 5 {
+		t.Errorf("clientToUpstream = %d, want 5", obs.clientToUpstream)
+	}
+}
+
+func TestProxyDoneForceCloses(t *testing.T) {
+	clientConn, clientPeer := net.Pipe()
+	upstreamConn, upstreamPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer upstreamPeer.Close()
+
+	obs := &recordingObserver{}
+	pool := NewPool(0)
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		pool.Proxy(
+			done,
+			Endpoint{Reader: clientConn, Writer: clientConn, Conn: clientConn},
+			Endpoint{Reader: upstreamConn, Writer: upstreamConn, Conn: upstreamConn},
+			obs,
+		)
+		close(finished)
+	}()
+
+	// Neither side sends or closes, so both copies are blocked on a read.
+	// Closing done must force both Conns closed and unblock Proxy.
+	close(done)
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Proxy did not return after done was closed")
+	}
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if !obs.called {
+		t.Fatal("observer.OnClose was never called")
+	}
+	if obs.clientErr == nil && obs.upstreamErr == nil {
+		t.Error("expected at least one direction to report an error after force-close")
+	}
+}
+
+func TestProxyNormalizesEOFToNil(t *testing.T) {
+	clientConn, clientPeer := net.Pipe()
+	upstreamConn, upstreamPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer upstreamPeer.Close()
+
+	obs := &recordingObserver{}
+	pool := NewPool(0)
+
+	done := make(chan struct{})
+	go func() {
+		pool.Proxy(
+			done,
+			Endpoint{Reader: clientConn, Writer: clientConn, Conn: clientConn},
+			Endpoint{Reader: upstreamConn, Writer: upstreamConn, Conn: upstreamConn},
+			obs,
+		)
+		close(done)
+	}()
+
+	clientPeer.Close()
+	upstreamPeer.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Proxy did not return after both peers closed")
+	}
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if !obs.called {
+		t.Fatal("observer.OnClose was never called")
+	}
+	if errors.Is(obs.clientErr, io.EOF) || errors.Is(obs.upstreamErr, io.EOF) {
+		t.Error("io.EOF should be normalized to nil, not reported to the observer")
+	}
+}